@@ -2,7 +2,7 @@ package main
 
 import (
 	"bytes"
-	"cache"
+	"context"
 	"flag"
 	"fmt"
 	"fractal"
@@ -10,21 +10,38 @@ import (
 	"fractal/julia"
 	"fractal/mandelbrot"
 	"fractal/solid"
+	"fractal/tilestore"
 	"html/template"
+	"image"
+	"image/color"
 	"image/png"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// tileSize is the pixel width/height of a single slippy-map tile.
+const tileSize = 256
+
 var factory map[string]func(o fractal.Options) (fractal.Fractal, error)
 var port string
-var cacheDir string
+var tileStoreURL string
 var disableCache bool
-var pngCache cache.Cache
+var maxCacheBytes int64
+var pngCache *lruCache
+var store tilestore.TileStore
+
+// inflight de-duplicates concurrent renders of the same cacheKey so that N
+// simultaneous requests for a tile trigger exactly one render.
+var inflight = struct {
+	sync.Mutex
+	m map[string]*sync.WaitGroup
+}{m: make(map[string]*sync.WaitGroup)}
 
 type cachedPng struct {
 	Timestamp time.Time
@@ -35,12 +52,22 @@ func (c cachedPng) Size() int {
 	return len(c.Bytes)
 }
 
+// ETag returns a strong entity tag derived from the tile's render time and
+// size, suitable for If-None-Match comparisons.
+func (c cachedPng) ETag() string {
+	return fmt.Sprintf(`"%x-%x"`, c.Timestamp.Unix(), len(c.Bytes))
+}
+
 func init() {
 	flag.StringVar(&port, "port", "8000", "webserver listen port")
-	flag.StringVar(&cacheDir, "cacheDir", "/tmp/fractals",
-		"directory to store rendered tiles. Directory must exist")
+	flag.StringVar(&tileStoreURL, "tileStore", "fs:///tmp/fractals",
+		"tile storage backend, e.g. fs:///tmp/fractals or s3://my-bucket/prefix. "+
+			"The fs:// directory must exist")
 	flag.BoolVar(&disableCache, "disableCache", false,
 		"never serve from disk cache")
+	flag.Int64Var(&maxCacheBytes, "maxCacheBytes", 256<<20,
+		"maximum total size in bytes of the in-memory tile cache, "+
+			"least-recently-used tiles are evicted once exceeded")
 	flag.Parse()
 
 	factory = map[string]func(o fractal.Options) (fractal.Fractal, error){
@@ -52,8 +79,24 @@ func init() {
 		//"lyapunov": lyapunov.NewFractal,
 	}
 
-	// TODO(wathiede): load tiles on startup
-	pngCache = *cache.NewCache()
+	pngCache = newLRUCache(maxCacheBytes)
+
+	var err error
+	store, err = tilestore.New(tileStoreURL)
+	if err != nil {
+		log.Fatalf("Failed to open tile store %q: %s", tileStoreURL, err)
+	}
+
+	n := 0
+	err = store.Walk(func(key string, b []byte, ts time.Time) error {
+		pngCache.Add(key, cachedPng{ts, b})
+		n++
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to warm tile cache from %q: %s", tileStoreURL, err)
+	}
+	log.Printf("Warmed tile cache with %d tiles from %q", n, tileStoreURL)
 }
 
 func main() {
@@ -70,8 +113,12 @@ func main() {
 		log.Fatalf("Directory %s not found, please run for directory containing %s\n", s, s)
 	}
 
-	http.Handle("/"+s, http.StripPrefix("/"+s, http.FileServer(http.Dir(s))))
-	http.HandleFunc("/", IndexServer)
+	mux := http.NewServeMux()
+	mux.HandleFunc(tilePathPrefix, TileServer)
+	mux.Handle("/"+s, http.StripPrefix("/"+s, http.FileServer(http.Dir(s))))
+	mux.HandleFunc("/", IndexServer)
+
+	http.Handle("/", mux)
 	log.Fatal(http.ListenAndServe(":" + port, nil))
 }
 
@@ -87,98 +134,261 @@ func drawFractalPage(w http.ResponseWriter, req *http.Request, fracType string)
 	}
 }
 
-func fsNameFromURL(url string) string {
-	cleanup := func(r rune) rune {
-		switch r {
-		case '?':
-			return '/'
-		case '&':
-			return ','
-		}
-		return r
+// saveToStore hands cp off to the configured tilestore.TileStore under
+// cacheKey.
+func saveToStore(ctx context.Context, cacheKey string, cp cachedPng) {
+	if err := store.Put(cacheKey, cp.Bytes, cp.Timestamp); err != nil {
+		log.Printf("Failed to save %q to tile store: %s", cacheKey, err)
 	}
-	return strings.Map(cleanup, url)
 }
 
-func savePngFromCache(cacheKey string) {
-	cacher, ok := pngCache.Get(cacheKey)
-	if !ok {
-		log.Printf("Attempt to save %q to disk, but image not in cache",
-			cacheKey)
-		return
+// renderTile returns the cachedPng for fracType/opts, rendering and
+// populating pngCache under cacheKey if it isn't already present. Concurrent
+// callers sharing the same cacheKey de-duplicate onto a single render via
+// inflight.
+func renderTile(ctx context.Context, fracType string, opts fractal.Options, cacheKey string) (cachedPng, error) {
+	if disableCache {
+		i, err := renderFractal(ctx, fracType, opts)
+		if err != nil {
+			return cachedPng{}, err
+		}
+		b := encodePng(ctx, i)
+		return cachedPng{time.Now(), b}, nil
 	}
 
-	cachefn := cacheDir + cacheKey
-	d := path.Dir(cachefn)
-	if _, err := os.Stat(d); err != nil {
-		log.Printf("Creating cache dir for %q", d)
-		err = os.Mkdir(d, 0700)
+	if cacher, ok := pngCache.Get(cacheKey); ok {
+		return cacher.(cachedPng), nil
 	}
 
-	_, err := os.Stat(cachefn)
-	if err == nil {
-		log.Printf("Attempt to save %q to %q, but file already exists",
-			cacheKey, cachefn)
-		return
+	wg, leader := joinInflight(cacheKey)
+	if !leader {
+		wg.Wait()
+		if cacher, ok := pngCache.Get(cacheKey); ok {
+			return cacher.(cachedPng), nil
+		}
+		// The render we waited on failed; re-join inflight rather than
+		// rendering unconditionally, so only one of the waiters that
+		// raced here becomes the new leader.
+		return renderTile(ctx, fracType, opts, cacheKey)
 	}
+	defer leaveInflight(cacheKey, wg)
 
-	outf, err := os.OpenFile(cachefn, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("Failed to open tile %q for save: %s", cachefn, err)
-		return
+	// A previous leader may have finished between the cache miss above and
+	// joinInflight; reuse its result instead of rendering again.
+	if cacher, ok := pngCache.Get(cacheKey); ok {
+		return cacher.(cachedPng), nil
 	}
-	cp := cacher.(cachedPng)
-	outf.Write(cp.Bytes)
-	outf.Close()
 
-	err = os.Chtimes(cachefn, cp.Timestamp, cp.Timestamp)
+	// No png in cache, create one
+	i, err := renderFractal(ctx, fracType, opts)
 	if err != nil {
-		log.Printf("Error setting atime and mtime on %q: %s", cachefn, err)
+		return cachedPng{}, err
 	}
+
+	b := encodePng(ctx, i)
+	cp := cachedPng{time.Now(), b}
+	pngCache.Add(cacheKey, cp)
+	saveToStore(ctx, cacheKey, cp)
+
+	return cp, nil
 }
 
-func drawFractal(w http.ResponseWriter, req *http.Request, fracType string) {
-	if disableCache {
-		i, err := factory[fracType](fractal.Options{req.URL.Query()})
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+// joinInflight registers the caller as waiting on cacheKey's in-flight
+// render, returning the shared WaitGroup and whether the caller is the
+// leader responsible for actually rendering (and must call leaveInflight
+// when done).
+func joinInflight(cacheKey string) (wg *sync.WaitGroup, leader bool) {
+	inflight.Lock()
+	defer inflight.Unlock()
+
+	if wg, ok := inflight.m[cacheKey]; ok {
+		return wg, false
+	}
+	wg = &sync.WaitGroup{}
+	wg.Add(1)
+	inflight.m[cacheKey] = wg
+	return wg, true
+}
+
+// leaveInflight releases the leader's claim on cacheKey, waking any
+// waiters blocked in renderTile's wg.Wait().
+func leaveInflight(cacheKey string, wg *sync.WaitGroup) {
+	inflight.Lock()
+	delete(inflight.m, cacheKey)
+	inflight.Unlock()
+	wg.Done()
+}
+
+// renderFractal renders fracType via the configured factory function.
+func renderFractal(ctx context.Context, fracType string, opts fractal.Options) (fractal.Fractal, error) {
+	return factory[fracType](opts)
+}
+
+// encodePng encodes i as PNG.
+func encodePng(ctx context.Context, i fractal.Fractal) []byte {
+	b := &bytes.Buffer{}
+	png.Encode(b, i)
+	return b.Bytes()
+}
+
+// servePng writes cp to w, setting cache-related headers and honoring
+// If-None-Match/If-Modified-Since by replying 304 Not Modified when the
+// client's copy is still current.
+func servePng(w http.ResponseWriter, req *http.Request, cp cachedPng) {
+	etag := cp.ETag()
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", cp.Timestamp.Format(http.TimeFormat))
+	w.Header().Set("Expires",
+		cp.Timestamp.Add(time.Hour).Format(http.TimeFormat))
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" && inm == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if ims, err := time.Parse(http.TimeFormat, req.Header.Get("If-Modified-Since")); err == nil {
+		if !cp.Timestamp.After(ims) {
+			w.WriteHeader(http.StatusNotModified)
 			return
 		}
-		png.Encode(w, i)
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(cp.Bytes)
+}
+
+func drawFractal(w http.ResponseWriter, req *http.Request, fracType string) {
+	cacheKey := req.URL.RequestURI()
+	cp, err := renderTile(req.Context(), fracType, fractal.Options{req.URL.Query()}, cacheKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	servePng(w, req, cp)
+}
+
+// tilePathPrefix is the path under which TileServer is registered; it must
+// end in "/" so it matches as a ServeMux subtree.
+const tilePathPrefix = "/tiles/"
+
+// parseTilePath parses the {fracType}/{z}/{x}/{y}.png portion of a tile
+// request path (with tilePathPrefix already stripped) into its fields.
+func parseTilePath(p string) (fracType string, z, x, y int, ok bool) {
+	if !strings.HasSuffix(p, ".png") {
+		return "", 0, 0, 0, false
+	}
+	parts := strings.Split(strings.TrimSuffix(p, ".png"), "/")
+	if len(parts) != 4 {
+		return "", 0, 0, 0, false
+	}
+
+	fracType = parts[0]
+	z, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, 0, 0, false
+	}
+	x, err = strconv.Atoi(parts[2])
+	if err != nil {
+		return "", 0, 0, 0, false
+	}
+	y, err = strconv.Atoi(parts[3])
+	if err != nil {
+		return "", 0, 0, 0, false
+	}
+	return fracType, z, x, y, true
+}
 
-	cacheKey := fsNameFromURL(req.URL.RequestURI())
-	cacher, ok := pngCache.Get(cacheKey)
-	// TODO(wathiede): log cache hits as expvar
+// TileServer serves /tiles/{fracType}/{z}/{x}/{y}.png, translating the
+// slippy-map (z, x, y) tile coordinates into the fractal.Options expected
+// by the factory functions, feeding DefaultNavigator with the computed
+// offset and zoom.
+func TileServer(w http.ResponseWriter, req *http.Request) {
+	fracType, z, x, y, ok := parseTilePath(strings.TrimPrefix(req.URL.Path, tilePathPrefix))
 	if !ok {
-		// No png in cache, create one
-		i, err := factory[fracType](fractal.Options{req.URL.Query()})
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.NotFound(w, req)
+		return
+	}
+	if _, ok := factory[fracType]; !ok {
+		http.Error(w, fmt.Sprintf("unknown fractal type %q", fracType),
+			http.StatusNotFound)
+		return
+	}
+
+	v := url.Values{}
+	v.Set("zoom", strconv.Itoa(z+8))
+	v.Set("xoff", strconv.Itoa(x*tileSize))
+	v.Set("yoff", strconv.Itoa(y*tileSize))
+	opts := fractal.Options{v}
+
+	cacheKey := req.URL.Path
+	if !disableCache {
+		if cacher, ok := pngCache.Get(cacheKey); ok {
+			servePng(w, req, cacher.(cachedPng))
 			return
 		}
 
-		b := &bytes.Buffer{}
-		png.Encode(b, i)
-		cacher = cachedPng{time.Now(), b.Bytes()}
-		pngCache.Add(cacheKey, cacher)
+		if up, ok := upscaleFromLowerZoom(fracType, z, x, y); ok {
+			// Kick off the real render in the background and return the
+			// upscaled placeholder immediately so zooming in feels snappy.
+			go renderTile(context.Background(), fracType, opts, cacheKey)
 
-		// Async save image to disk
-		// TODO make this a channel and serialize saving of images
-		go savePngFromCache(cacheKey)
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Expires", time.Now().Add(2*time.Second).Format(http.TimeFormat))
+			png.Encode(w, up)
+			return
+		}
 	}
 
-	cp := cacher.(cachedPng)
+	cp, err := renderTile(req.Context(), fracType, opts, cacheKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	servePng(w, req, cp)
+}
 
+// maxUpscaleLevels bounds how many zoom levels upscaleFromLowerZoom will
+// walk up looking for a cached ancestor tile to blow up.
+const maxUpscaleLevels = 3
 
-	// Using this instead of io.Copy, sets Last-Modified which helps given
-	// the way the maps API makes lots of re-requests
-	w.Header().Set("Content-Type", "image/png")
-	w.Header().Set("Last-Modified", cp.Timestamp.Format(http.TimeFormat))
-	w.Header().Set("Expires",
-		cp.Timestamp.Add(time.Hour).Format(http.TimeFormat))
-	w.Write(cp.Bytes)
+// subImage crops img to r, used to pick the quadrant of a lower-zoom tile
+// that covers the requested higher-zoom tile before upscaling it.
+type subImage struct {
+	img image.Image
+	r   image.Rectangle
+}
+
+func (s subImage) ColorModel() color.Model { return s.img.ColorModel() }
+func (s subImage) Bounds() image.Rectangle { return s.r }
+func (s subImage) At(x, y int) color.Color { return s.img.At(x, y) }
+
+// upscaleFromLowerZoom looks for a cached tile covering the same fractal
+// region at a coarser zoom level (z-1, z-2, ...) and, if found, blows the
+// relevant quadrant of it up to tileSize via fractal.UpscaleTile.
+func upscaleFromLowerZoom(fracType string, z, x, y int) (*image.RGBA, bool) {
+	for k := 1; k <= maxUpscaleLevels && z-k >= 0; k++ {
+		scale := 1 << uint(k)
+		pz, px, py := z-k, x/scale, y/scale
+
+		parentKey := fmt.Sprintf("/tiles/%s/%d/%d/%d.png", fracType, pz, px, py)
+		cacher, ok := pngCache.Get(parentKey)
+		if !ok {
+			continue
+		}
+
+		parent, err := png.Decode(bytes.NewReader(cacher.(cachedPng).Bytes))
+		if err != nil {
+			continue
+		}
+
+		subSize := tileSize / scale
+		offX := (x % scale) * subSize
+		offY := (y % scale) * subSize
+		r := image.Rect(offX, offY, offX+subSize, offY+subSize)
+		src := subImage{parent, r}
+
+		return fractal.UpscaleTile(src, image.Pt(tileSize, tileSize)), true
+	}
+	return nil, false
 }
 
 func IndexServer(w http.ResponseWriter, req *http.Request) {
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// sizer is implemented by cache values that know their own size in bytes,
+// used to bound lruCache by total bytes rather than entry count.
+type sizer interface {
+	Size() int
+}
+
+type lruEntry struct {
+	key   string
+	value sizer
+}
+
+// lruCache is a fixed-byte-budget, least-recently-used cache. Entries are
+// evicted oldest-first once the sum of Size() across all entries exceeds
+// maxBytes. It is safe for concurrent use.
+type lruCache struct {
+	mu        sync.Mutex
+	maxBytes  int64
+	curBytes  int64
+	ll        *list.List
+	items     map[string]*list.Element
+}
+
+// newLRUCache returns an lruCache that evicts entries once the total size
+// of its contents exceeds maxBytes.
+func newLRUCache(maxBytes int64) *lruCache {
+	return &lruCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value stored under key, promoting it to most-recently-used.
+func (c *lruCache) Get(key string) (sizer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// Add inserts value under key, evicting least-recently-used entries as
+// needed to stay within maxBytes.
+func (c *lruCache) Add(key string, value sizer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		old := e.Value.(*lruEntry)
+		c.curBytes += int64(value.Size() - old.value.Size())
+		old.value = value
+	} else {
+		e := c.ll.PushFront(&lruEntry{key, value})
+		c.items[key] = e
+		c.curBytes += int64(value.Size())
+	}
+
+	for c.maxBytes > 0 && c.curBytes > c.maxBytes {
+		c.removeOldest()
+	}
+}
+
+// removeOldest evicts the least-recently-used entry. Callers must hold c.mu.
+func (c *lruCache) removeOldest() {
+	e := c.ll.Back()
+	if e == nil {
+		return
+	}
+	c.ll.Remove(e)
+	ent := e.Value.(*lruEntry)
+	delete(c.items, ent.key)
+	c.curBytes -= int64(ent.value.Size())
+}
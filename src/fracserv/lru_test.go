@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+type sizedValue int
+
+func (v sizedValue) Size() int { return int(v) }
+
+func TestLRUCacheEvictsByBytes(t *testing.T) {
+	c := newLRUCache(10)
+
+	c.Add("a", sizedValue(4))
+	c.Add("b", sizedValue(4))
+	c.Add("c", sizedValue(4)) // total would be 12 > 10, "a" should be evicted
+
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Get(a) = found, want evicted")
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Errorf("Get(b) = not found, want present")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Errorf("Get(c) = not found, want present")
+	}
+}
+
+func TestLRUCacheGetPromotesToFront(t *testing.T) {
+	c := newLRUCache(10)
+
+	c.Add("a", sizedValue(4))
+	c.Add("b", sizedValue(4))
+	c.Get("a") // touch "a" so "b" becomes the least-recently-used entry
+	c.Add("c", sizedValue(4))
+
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("Get(b) = found, want evicted as least-recently-used")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("Get(a) = not found, want present (recently touched)")
+	}
+}
+
+func TestLRUCacheConcurrentGetAdd(t *testing.T) {
+	c := newLRUCache(1 << 20)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := string(rune('a' + i%26))
+			c.Add(key, sizedValue(1))
+			c.Get(key)
+		}(i)
+	}
+	wg.Wait()
+}
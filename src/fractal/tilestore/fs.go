@@ -0,0 +1,154 @@
+package tilestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// writeQueueLen bounds how many pending Puts an FSStore will buffer before
+// Put starts blocking the caller.
+const writeQueueLen = 64
+
+type writeReq struct {
+	key   string
+	bytes []byte
+	ts    time.Time
+}
+
+// FSStore is a TileStore backed by the local filesystem. Writes go through
+// a single serialized writer goroutine, and each tile is written to a
+// temp file and renamed into place so a reader never observes a
+// half-written PNG.
+type FSStore struct {
+	dir    string
+	writes chan writeReq
+}
+
+// NewFSStore returns an FSStore rooted at dir, which must already exist.
+func NewFSStore(dir string) *FSStore {
+	s := &FSStore{
+		dir:    dir,
+		writes: make(chan writeReq, writeQueueLen),
+	}
+	go s.writeLoop()
+	return s
+}
+
+// keyToPath maps a tile key (a request path, possibly with a query string
+// appended) to a relative path by replacing '?' with '/' and '&' with ','.
+// All other characters, including ".." path elements, are kept as they are.
+func keyToPath(key string) string {
+	cleanup := func(r rune) rune {
+		switch r {
+		case '?':
+			return '/'
+		case '&':
+			return ','
+		}
+		return r
+	}
+	return strings.Map(cleanup, key)
+}
+
+func (s *FSStore) writeLoop() {
+	for r := range s.writes {
+		if err := s.writeAtomic(r.key, r.bytes, r.ts); err != nil {
+			log.Printf("tilestore: failed to save %q: %s", r.key, err)
+		}
+	}
+}
+
+// keySuffix names the sidecar file written next to each tile that holds
+// its original, un-sanitized key, so Walk can recover it losslessly
+// (keyToPath's '?'/'&' mapping isn't invertible).
+const keySuffix = ".key"
+
+func (s *FSStore) writeAtomic(key string, b []byte, ts time.Time) error {
+	fn := filepath.Join(s.dir, keyToPath(key))
+	d := filepath.Dir(fn)
+	if err := os.MkdirAll(d, 0700); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(d, fn+keySuffix, []byte(key), time.Time{}); err != nil {
+		return err
+	}
+	return writeFileAtomic(d, fn, b, ts)
+}
+
+// writeFileAtomic writes b to a temp file in dir and renames it into
+// place at fn, so a reader never observes a half-written file. ts, if
+// non-zero, is applied as the file's mtime/atime.
+func writeFileAtomic(dir, fn string, b []byte, ts time.Time) error {
+	tmp, err := ioutil.TempFile(dir, ".tile-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if !ts.IsZero() {
+		if err := os.Chtimes(tmp.Name(), ts, ts); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), fn)
+}
+
+// Put enqueues b to be written under key by the serialized writer
+// goroutine, returning before the write completes.
+func (s *FSStore) Put(key string, b []byte, ts time.Time) error {
+	s.writes <- writeReq{key, b, ts}
+	return nil
+}
+
+// Get reads the tile stored under key from disk.
+func (s *FSStore) Get(key string) ([]byte, time.Time, error) {
+	fn := filepath.Join(s.dir, keyToPath(key))
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return b, fi.ModTime(), nil
+}
+
+// Walk calls fn once for every tile on disk, used to warm the in-memory
+// cache on startup. The key passed to fn is the original key Put was
+// called with, recovered from each tile's ".key" sidecar file.
+func (s *FSStore) Walk(fn func(key string, b []byte, ts time.Time) error) error {
+	return filepath.Walk(s.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || strings.HasSuffix(p, ".tmp") || strings.HasSuffix(p, keySuffix) {
+			return nil
+		}
+
+		key, err := ioutil.ReadFile(p + keySuffix)
+		if err != nil {
+			return fmt.Errorf("tilestore: missing key sidecar for %q: %s", p, err)
+		}
+
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("tilestore: failed to read %q: %s", p, err)
+		}
+		return fn(string(key), b, fi.ModTime())
+	})
+}
@@ -0,0 +1,101 @@
+package tilestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFSStore(t *testing.T) (*FSStore, func()) {
+	dir, err := ioutil.TempDir("", "tilestore_test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	return NewFSStore(dir), func() { os.RemoveAll(dir) }
+}
+
+// putSync calls Put and blocks until the write has made it through the
+// serialized writer goroutine, so tests can observe the result.
+func putSync(t *testing.T, s *FSStore, key string, b []byte, ts time.Time) {
+	t.Helper()
+	if err := s.Put(key, b, ts); err != nil {
+		t.Fatalf("Put(%q): %s", key, err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, _, err := s.Get(key); err == nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Put(%q) never became visible via Get", key)
+}
+
+func TestFSStoreGetPutRoundTrip(t *testing.T) {
+	s, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	want := []byte("fake png bytes")
+	ts := time.Unix(1234567890, 0)
+	putSync(t, s, "/tiles/mandelbrot/5/10/12.png", want, ts)
+
+	got, gotTS, err := s.Get("/tiles/mandelbrot/5/10/12.png")
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("Get bytes = %q, want %q", got, want)
+	}
+	if !gotTS.Equal(ts) {
+		t.Errorf("Get ts = %v, want %v", gotTS, ts)
+	}
+}
+
+func TestFSStoreWriteIsAtomic(t *testing.T) {
+	s, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	putSync(t, s, "/mandelbrot?zoom=5&xoff=10", []byte("data"), time.Unix(1, 0))
+
+	err := filepath.Walk(s.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && filepath.Ext(p) == ".tmp" {
+			t.Errorf("leftover temp file after write: %q", p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %s", err)
+	}
+}
+
+func TestFSStoreWalkRoundTripsKey(t *testing.T) {
+	s, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	// Exercises the '?'/'&' that keyToPath maps onto '/'/',', which Walk
+	// must still report back as the original key.
+	const key = "/mandelbrot?zoom=5&xoff=10"
+	want := []byte("data")
+	putSync(t, s, key, want, time.Unix(42, 0))
+
+	found := false
+	err := s.Walk(func(k string, b []byte, ts time.Time) error {
+		if k == key {
+			found = true
+			if string(b) != string(want) {
+				t.Errorf("Walk bytes for %q = %q, want %q", k, b, want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %s", err)
+	}
+	if !found {
+		t.Errorf("Walk never reported key %q", key)
+	}
+}
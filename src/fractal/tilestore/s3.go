@@ -0,0 +1,40 @@
+package tilestore
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// ObjectStore is a TileStore backed by an S3/GCS-compatible object store,
+// letting multiple fracserv replicas share one tile cache. It's a stub:
+// the bucket/prefix are parsed from the URL, but the actual object-store
+// calls are not yet implemented.
+type ObjectStore struct {
+	bucket string
+	prefix string
+}
+
+// NewObjectStore builds an ObjectStore from a "s3://bucket/prefix" or
+// "gcs://bucket/prefix" URL.
+func NewObjectStore(u *url.URL) (*ObjectStore, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("tilestore: %s:// url missing bucket name", u.Scheme)
+	}
+	return &ObjectStore{
+		bucket: u.Host,
+		prefix: u.Path,
+	}, nil
+}
+
+func (s *ObjectStore) Get(key string) ([]byte, time.Time, error) {
+	return nil, time.Time{}, fmt.Errorf("tilestore: %s backend not implemented", s.bucket)
+}
+
+func (s *ObjectStore) Put(key string, b []byte, ts time.Time) error {
+	return fmt.Errorf("tilestore: %s backend not implemented", s.bucket)
+}
+
+func (s *ObjectStore) Walk(fn func(key string, b []byte, ts time.Time) error) error {
+	return fmt.Errorf("tilestore: %s backend not implemented", s.bucket)
+}
@@ -0,0 +1,39 @@
+// Package tilestore persists rendered fractal tiles so they survive a
+// server restart and can be shared across replicas.
+package tilestore
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// TileStore persists and retrieves rendered tile bytes by key, where key
+// is the tile's request path (e.g. "/tiles/mandelbrot/5/10/12.png").
+type TileStore interface {
+	// Get returns the bytes and last-modified time stored under key.
+	Get(key string) ([]byte, time.Time, error)
+	// Put stores b under key, recording ts as its last-modified time.
+	Put(key string, b []byte, ts time.Time) error
+	// Walk calls fn once per stored tile, used to warm the in-memory
+	// cache on startup.
+	Walk(fn func(key string, b []byte, ts time.Time) error) error
+}
+
+// New builds a TileStore from a URL such as "fs:///tmp/fractals" or
+// "s3://my-bucket/prefix", dispatching on the scheme.
+func New(rawURL string) (TileStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("tilestore: invalid url %q: %s", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "fs":
+		return NewFSStore(u.Path), nil
+	case "s3", "gcs":
+		return NewObjectStore(u)
+	default:
+		return nil, fmt.Errorf("tilestore: unknown scheme %q in %q", u.Scheme, rawURL)
+	}
+}
@@ -0,0 +1,52 @@
+package fractal
+
+import (
+	"image"
+	"image/color"
+)
+
+// fixedShift is the number of fractional bits used by the Q8 fixed-point
+// coordinates UpscaleTile walks the destination image with.
+const fixedShift = 8
+
+// UpscaleTile performs a nearest-neighbor blow up of src into an image of
+// size dstSize. It walks the destination pixels advancing in Q8
+// fixed-point, so a row of identical source samples costs one src.At call
+// instead of one per destination pixel. It's meant to give a quick,
+// blocky preview of a tile at the next zoom level while the real render
+// happens in the background.
+func UpscaleTile(src image.Image, dstSize image.Point) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, dstSize.X, dstSize.Y))
+	sb := src.Bounds()
+	if sb.Dx() <= 0 || sb.Dy() <= 0 || dstSize.X <= 0 || dstSize.Y <= 0 {
+		return dst
+	}
+
+	dx := (sb.Dx() << fixedShift) / dstSize.X
+	dy := (sb.Dy() << fixedShift) / dstSize.Y
+
+	py := 0
+	for y := 0; y < dstSize.Y; y++ {
+		sy := sb.Min.Y + (py >> fixedShift)
+
+		px := 0
+		lastSX, lastSY := -1, -1
+		var lastColor color.Color
+		for x := 0; x < dstSize.X; x++ {
+			sx := sb.Min.X + (px >> fixedShift)
+
+			var c color.Color
+			if sx == lastSX && sy == lastSY {
+				c = lastColor
+			} else {
+				c = src.At(sx, sy)
+				lastSX, lastSY = sx, sy
+				lastColor = c
+			}
+			dst.Set(x, y, c)
+			px += dx
+		}
+		py += dy
+	}
+	return dst
+}
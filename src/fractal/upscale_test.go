@@ -0,0 +1,36 @@
+package fractal
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestUpscaleTile(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+	src.Set(0, 1, blue)
+	src.Set(1, 1, red)
+
+	dst := UpscaleTile(src, image.Pt(4, 4))
+	if got := dst.Bounds().Size(); got != (image.Point{4, 4}) {
+		t.Fatalf("UpscaleTile size = %v, want {4 4}", got)
+	}
+
+	want := [][]color.RGBA{
+		{red, red, blue, blue},
+		{red, red, blue, blue},
+		{blue, blue, red, red},
+		{blue, blue, red, red},
+	}
+	for y, row := range want {
+		for x, c := range row {
+			if got := dst.RGBAAt(x, y); got != c {
+				t.Errorf("UpscaleTile pixel (%d,%d) = %v, want %v", x, y, got, c)
+			}
+		}
+	}
+}